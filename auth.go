@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"github.com/dgrijalva/jwt-go"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// UserConfiguration is one entry in the Auth.Users list in config.json.
+// Passwords are plain text in config.json the same way the SSH private
+// key path is today; operators are expected to lock down file
+// permissions on that file.
+type UserConfiguration struct {
+	Username string
+	Password string
+}
+
+type AuthConfiguration struct {
+	Secret string
+	Users  []UserConfiguration
+}
+
+// LoginRequest is the POST /login request body.
+type LoginRequest struct {
+	Username string `json:"username" form:"username"`
+	Password string `json:"password" form:"password"`
+}
+
+// UserTokenClaims is the JWT claim set issued by POST /login and checked
+// by requireAuth on every mutating route.
+type UserTokenClaims struct {
+	Username string `json:"username"`
+	jwt.StandardClaims
+}
+
+const tokenLifetime = 24 * time.Hour
+
+// login checks username/password against AppConfiguration.Auth.Users and
+// returns a signed JWT on success.
+func (state *AppState) login(username, password string) (string, error) {
+	for _, u := range state.Configuration.Auth.Users {
+		if u.Username == username && u.Password == password {
+			claims := UserTokenClaims{
+				Username: username,
+				StandardClaims: jwt.StandardClaims{
+					IssuedAt:  time.Now().Unix(),
+					ExpiresAt: time.Now().Add(tokenLifetime).Unix(),
+				},
+			}
+
+			token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+			return token.SignedString([]byte(state.Configuration.Auth.Secret))
+		}
+	}
+
+	return "", errors.New("invalid username or password")
+}
+
+// requireAuth is martini middleware guarding mutating routes. Requests
+// must carry a valid "Authorization: Bearer <token>" header signed with
+// Auth.Secret.
+func (state *AppState) requireAuth(w http.ResponseWriter, req *http.Request) {
+	header := req.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	raw := strings.TrimPrefix(header, "Bearer ")
+	token, err := jwt.ParseWithClaims(raw, &UserTokenClaims{}, func(t *jwt.Token) (interface{}, error) {
+		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, errors.New("unexpected signing method: " + t.Method.Alg())
+		}
+		return []byte(state.Configuration.Auth.Secret), nil
+	})
+	if err != nil || !token.Valid {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"github.com/dgrijalva/jwt-go"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func authTestState(secret string) *AppState {
+	return &AppState{
+		Configuration: AppConfiguration{
+			Auth: AuthConfiguration{
+				Secret: secret,
+				Users:  []UserConfiguration{{Username: "alice", Password: "hunter2"}},
+			},
+		},
+	}
+}
+
+func TestLoginSucceedsWithValidCredentials(t *testing.T) {
+	state := authTestState("sekrit")
+
+	token, err := state.login("alice", "hunter2")
+	if err != nil {
+		t.Fatalf("login: %v", err)
+	}
+	if token == "" {
+		t.Fatal("expected a non-empty token")
+	}
+}
+
+func TestLoginRejectsBadCredentials(t *testing.T) {
+	state := authTestState("sekrit")
+
+	if _, err := state.login("alice", "wrong"); err == nil {
+		t.Fatal("expected an error for a wrong password")
+	}
+}
+
+func requestWithBearer(token string) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "/press", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	return req
+}
+
+func TestRequireAuthAcceptsValidToken(t *testing.T) {
+	state := authTestState("sekrit")
+
+	token, err := state.login("alice", "hunter2")
+	if err != nil {
+		t.Fatalf("login: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	state.requireAuth(w, requestWithBearer(token))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("requireAuth status = %d, want %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestRequireAuthRejectsMissingHeader(t *testing.T) {
+	state := authTestState("sekrit")
+
+	w := httptest.NewRecorder()
+	state.requireAuth(w, httptest.NewRequest(http.MethodPost, "/press", nil))
+
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("requireAuth status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestRequireAuthRejectsWrongSecret(t *testing.T) {
+	state := authTestState("sekrit")
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, UserTokenClaims{Username: "alice"}).SignedString([]byte("not-the-secret"))
+	if err != nil {
+		t.Fatalf("SignedString: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	state.requireAuth(w, requestWithBearer(token))
+
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("requireAuth status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
+
+// TestRequireAuthRejectsAlgNone guards against the classic jwt-go
+// alg-confusion bug: a token that declares "alg":"none" (or any
+// non-HMAC method) must never be accepted just because the keyfunc
+// handed back the HMAC secret unconditionally.
+func TestRequireAuthRejectsAlgNone(t *testing.T) {
+	state := authTestState("sekrit")
+
+	token := jwt.NewWithClaims(jwt.SigningMethodNone, UserTokenClaims{Username: "alice"})
+	raw, err := token.SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if err != nil {
+		t.Fatalf("SignedString: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	state.requireAuth(w, requestWithBearer(raw))
+
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("requireAuth status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
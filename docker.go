@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/inconshreveable/log15"
+	"io"
+)
+
+func init() {
+	registerEndpointDriver("docker", newDockerEndpoint)
+}
+
+// dockerEndpoint runs the configured command via `docker exec` against
+// a named container, using the Docker Engine API so big-red can dump
+// container-to-container without sshd running inside either image.
+type dockerEndpoint struct {
+	client    *docker.Client
+	container string
+	logger    log15.Logger
+	waiter    docker.CloseWaiter
+}
+
+func newDockerEndpoint(config EndpointConfiguration, logger log15.Logger) (Endpoint, error) {
+	if config.Container == "" {
+		return nil, errors.New("docker endpoint requires a Container name")
+	}
+
+	client, err := docker.NewClientFromEnv()
+	if err != nil {
+		return nil, errors.New("Failed to create docker client: " + err.Error())
+	}
+
+	return &dockerEndpoint{client: client, container: config.Container, logger: logger}, nil
+}
+
+func (e *dockerEndpoint) Start(cmd string) (io.ReadCloser, io.WriteCloser, <-chan error) {
+	done := make(chan error, 1)
+
+	execObj, err := e.client.CreateExec(docker.CreateExecOptions{
+		Container:    e.container,
+		Cmd:          []string{"sh", "-c", cmd},
+		AttachStdin:  true,
+		AttachStdout: true,
+		AttachStderr: true,
+	})
+	if err != nil {
+		startErr := errors.New("Failed to create exec: " + err.Error())
+		done <- startErr
+		return errorReadCloser(startErr), errorWriteCloser(startErr), done
+	}
+
+	stdinReader, stdinWriter := io.Pipe()
+	stdoutReader, stdoutWriter := io.Pipe()
+
+	waiter, err := e.client.StartExecNonBlocking(execObj.ID, docker.StartExecOptions{
+		InputStream:  stdinReader,
+		OutputStream: stdoutWriter,
+		ErrorStream:  LoggerWriter{e.logger, log15.LvlWarn},
+	})
+	if err != nil {
+		startErr := errors.New("Failed to start exec: " + err.Error())
+		done <- startErr
+		return errorReadCloser(startErr), errorWriteCloser(startErr), done
+	}
+
+	e.waiter = waiter
+
+	go func() {
+		err := waiter.Wait()
+		stdoutWriter.Close()
+		done <- err
+	}()
+
+	return stdoutReader, stdinWriter, done
+}
+
+func (e *dockerEndpoint) Close() error {
+	if e.waiter != nil {
+		return e.waiter.Close()
+	}
+
+	return nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"github.com/inconshreveable/log15"
+	"io"
+	"os/exec"
+)
+
+func init() {
+	registerEndpointDriver("exec", newExecEndpoint)
+}
+
+// execEndpoint runs the configured command as a local child process,
+// for container-to-container or same-host dumps that don't need sshd at
+// all.
+type execEndpoint struct {
+	cmd    *exec.Cmd
+	logger log15.Logger
+}
+
+func newExecEndpoint(config EndpointConfiguration, logger log15.Logger) (Endpoint, error) {
+	return &execEndpoint{logger: logger}, nil
+}
+
+func (e *execEndpoint) Start(cmd string) (io.ReadCloser, io.WriteCloser, <-chan error) {
+	done := make(chan error, 1)
+
+	e.cmd = exec.Command("sh", "-c", cmd)
+	e.cmd.Stderr = LoggerWriter{e.logger, log15.LvlWarn}
+
+	stdout, err := e.cmd.StdoutPipe()
+	if err != nil {
+		startErr := errors.New("Could not create pipe: " + err.Error())
+		done <- startErr
+		return errorReadCloser(startErr), errorWriteCloser(startErr), done
+	}
+
+	stdin, err := e.cmd.StdinPipe()
+	if err != nil {
+		startErr := errors.New("Could not create pipe: " + err.Error())
+		done <- startErr
+		return errorReadCloser(startErr), errorWriteCloser(startErr), done
+	}
+
+	if err := e.cmd.Start(); err != nil {
+		startErr := errors.New("Failed to run command: " + err.Error())
+		done <- startErr
+		return errorReadCloser(startErr), errorWriteCloser(startErr), done
+	}
+
+	go func() {
+		done <- e.cmd.Wait()
+	}()
+
+	return stdout, stdin, done
+}
+
+func (e *execEndpoint) Close() error {
+	if e.cmd == nil || e.cmd.Process == nil {
+		return nil
+	}
+
+	return e.cmd.Process.Kill()
+}
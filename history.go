@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"github.com/boltdb/bolt"
+	"time"
+)
+
+var runsBucket = []byte("runs")
+
+// RunRecord is a single past dump, persisted so it survives restarts,
+// unlike the old single in-memory LastRun.
+type RunRecord struct {
+	ID           int
+	Pipeline     string
+	StartTime    time.Time
+	EndTime      time.Time
+	BytesRead    int64
+	BytesWritten int64
+	// StageBytes records how many bytes passed through each configured
+	// pipeline stage, keyed by the stage's position and name (e.g.
+	// "0:gzip", "1:encrypt").
+	StageBytes map[string]int64
+	Error      string
+	LogTail    []string
+}
+
+// RunHistory stores past runs in a bolt database, exposed over HTTP at
+// GET /runs and GET /runs/:id/log. Save never drops old runs; they are
+// only removed by Prune.
+type RunHistory struct {
+	db *bolt.DB
+}
+
+func openRunHistory(path string) (*RunHistory, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(runsBucket)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &RunHistory{db: db}, nil
+}
+
+func (h *RunHistory) Close() error {
+	return h.db.Close()
+}
+
+// Save inserts run, assigning it the next sequence ID if it doesn't
+// already have one.
+func (h *RunHistory) Save(run RunRecord) (RunRecord, error) {
+	err := h.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(runsBucket)
+
+		if run.ID == 0 {
+			id, err := b.NextSequence()
+			if err != nil {
+				return err
+			}
+			run.ID = int(id)
+		}
+
+		data, err := json.Marshal(run)
+		if err != nil {
+			return err
+		}
+
+		return b.Put(itob(run.ID), data)
+	})
+
+	return run, err
+}
+
+// List returns up to limit runs, most recent first. limit <= 0 means no
+// limit.
+func (h *RunHistory) List(limit int) ([]RunRecord, error) {
+	runs := []RunRecord{}
+
+	err := h.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(runsBucket).Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			var run RunRecord
+			if err := json.Unmarshal(v, &run); err != nil {
+				return err
+			}
+
+			runs = append(runs, run)
+			if limit > 0 && len(runs) >= limit {
+				break
+			}
+		}
+
+		return nil
+	})
+
+	return runs, err
+}
+
+func (h *RunHistory) Get(id int) (RunRecord, error) {
+	var run RunRecord
+
+	err := h.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(runsBucket).Get(itob(id))
+		if v == nil {
+			return errors.New("run not found")
+		}
+
+		return json.Unmarshal(v, &run)
+	})
+
+	return run, err
+}
+
+// Prune removes the oldest runs for pipeline beyond the most recent
+// keep, implementing a schedule's retention policy. keep <= 0 disables
+// pruning.
+func (h *RunHistory) Prune(pipeline string, keep int) error {
+	if keep <= 0 {
+		return nil
+	}
+
+	return h.db.Update(func(tx *bolt.Tx) error {
+		c := tx.Bucket(runsBucket).Cursor()
+
+		kept := 0
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			var run RunRecord
+			if err := json.Unmarshal(v, &run); err != nil {
+				return err
+			}
+			if run.Pipeline != pipeline {
+				continue
+			}
+
+			kept++
+			if kept > keep {
+				if err := c.Delete(); err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	})
+}
+
+func itob(id int) []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, uint64(id))
+	return buf
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"github.com/inconshreveable/log15"
+	"os"
+	"strings"
+	"sync"
+)
+
+// defaultLogTailLines bounds how many lines of a run's logs are kept in
+// memory for GET /runs/:id/log.
+const defaultLogTailLines = 200
+
+// newLogger builds the root logger for the app. Level and output format
+// are controlled by the LogLevel/LogJSON fields of AppConfiguration so
+// operators can dial verbosity, or ship JSON to something like ELK or
+// Loki, without a rebuild. The returned tailHandler mirrors whatever was
+// logged so it can be attached to a run record.
+func newLogger(config AppConfiguration) (log15.Logger, *tailHandler) {
+	logger := log15.New()
+
+	format := log15.LogfmtFormat()
+	if config.LogJSON {
+		format = log15.JsonFormat()
+	}
+
+	lvl, err := log15.LvlFromString(config.LogLevel)
+	if err != nil {
+		lvl = log15.LvlInfo
+	}
+
+	tail := newTailHandler(defaultLogTailLines, format)
+	handler := log15.MultiHandler(log15.StreamHandler(os.Stdout, format), tail)
+	logger.SetHandler(log15.LvlFilterHandler(lvl, handler))
+
+	return logger, tail
+}
+
+// tailHandler keeps the last maxLines formatted log lines in memory for
+// the currently running (or most recently run) dump.
+type tailHandler struct {
+	mutex    sync.Mutex
+	lines    []string
+	maxLines int
+	format   log15.Format
+}
+
+func newTailHandler(maxLines int, format log15.Format) *tailHandler {
+	return &tailHandler{maxLines: maxLines, format: format}
+}
+
+func (h *tailHandler) Log(r *log15.Record) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.lines = append(h.lines, strings.TrimRight(string(h.format.Format(r)), "\n"))
+	if len(h.lines) > h.maxLines {
+		h.lines = h.lines[len(h.lines)-h.maxLines:]
+	}
+
+	return nil
+}
+
+// Tail returns a copy of the lines logged since the last Reset.
+func (h *tailHandler) Tail() []string {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	tail := make([]string, len(h.lines))
+	copy(tail, h.lines)
+	return tail
+}
+
+// Reset clears the tail, called at the start of each run.
+func (h *tailHandler) Reset() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.lines = nil
+}
+
+// LoggerWriter adapts an io.Writer onto a leveled logger, so ssh session
+// stdout/stderr can be piped through the same structured logs as
+// everything else while keeping the stream (source/destination) tagged
+// on every line.
+type LoggerWriter struct {
+	Logger log15.Logger
+	Level  log15.Lvl
+}
+
+func (self LoggerWriter) Write(p []byte) (n int, err error) {
+	msg := strings.TrimRight(string(p), "\n")
+	if msg == "" {
+		return len(p), nil
+	}
+
+	switch self.Level {
+	case log15.LvlDebug:
+		self.Logger.Debug(msg)
+	case log15.LvlWarn:
+		self.Logger.Warn(msg)
+	case log15.LvlError:
+		self.Logger.Error(msg)
+	default:
+		self.Logger.Info(msg)
+	}
+
+	return len(p), nil
+}
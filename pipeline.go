@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/inconshreveable/log15"
+	"golang.org/x/sync/errgroup"
+	"io"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// PipelineConfiguration names a source/destination pair that can be
+// triggered manually via POST /press?pipeline=<name> or on a schedule.
+type PipelineConfiguration struct {
+	Source      EndpointConfiguration
+	Destination EndpointConfiguration
+	// Stages is an ordered list of transforms (compression, encryption)
+	// and tees (to a file or S3) applied to the stream between Source's
+	// stdout and Destination's stdin.
+	Stages []StageConfig
+}
+
+const defaultPipelineName = "default"
+
+// Pipeline is a configured source/destination pair together with the
+// state of its runs. Each pipeline has its own mutex so one pipeline
+// running doesn't block another, and its own logging so runs from
+// different pipelines don't interleave. All pipelines share one
+// RunHistory, in which each run is tagged with its pipeline's name.
+type Pipeline struct {
+	Name          string
+	Configuration PipelineConfiguration
+	Logger        log15.Logger
+	Tail          *tailHandler
+	History       *RunHistory
+
+	ChunkSize      int
+	MaxBufferBytes int64
+
+	mutex     sync.Mutex
+	Working   bool
+	StartTime *time.Time
+	LastRun   LastRun
+
+	// BytesRead, BytesWritten and BufferedBytes are updated from the
+	// reader/writer goroutines during Run and read from the HTTP
+	// handlers, so they're accessed atomically.
+	BytesRead     int64
+	BytesWritten  int64
+	BufferedBytes int64
+}
+
+// newPipeline builds a Pipeline with its own logger and log tail, kept
+// separate per pipeline so concurrent runs on different pipelines don't
+// interleave in GET /runs/:id/log.
+func newPipeline(name string, config PipelineConfiguration, appConfig AppConfiguration, history *RunHistory) *Pipeline {
+	logger, tail := newLogger(appConfig)
+
+	return &Pipeline{
+		Name:           name,
+		Configuration:  config,
+		Logger:         logger.New("pipeline", name),
+		Tail:           tail,
+		History:        history,
+		ChunkSize:      appConfig.ChunkSize,
+		MaxBufferBytes: appConfig.MaxBufferBytes,
+		LastRun:        LastRun{"", nil},
+	}
+}
+
+// TryStart atomically marks the pipeline as working, returning false if
+// it was already running. This is the per-pipeline equivalent of the old
+// global AppState.Working check-then-set, which raced under concurrent
+// /press calls.
+func (p *Pipeline) TryStart() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.Working {
+		return false
+	}
+
+	p.Working = true
+	return true
+}
+
+// StartedAt returns the current run's start time, or nil if the
+// pipeline isn't running. Guarded by the same mutex as Working since
+// both are set together at the start of Run and read concurrently by
+// the /status handler while a run is in flight.
+func (p *Pipeline) StartedAt() *time.Time {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return p.StartTime
+}
+
+// setStartTime is the mutex-guarded counterpart to StartedAt, used by
+// Run to set and clear p.StartTime.
+func (p *Pipeline) setStartTime(t *time.Time) {
+	p.mutex.Lock()
+	p.StartTime = t
+	p.mutex.Unlock()
+}
+
+func (p *Pipeline) Elapsed() time.Duration {
+	return time.Since(*p.StartedAt())
+}
+
+// Run streams the configured source command's stdout to the destination
+// command's stdin, through a bounded channel so a slow destination
+// applies backpressure to the source. Call TryStart first to make sure
+// only one Run is in flight for this pipeline at a time.
+func (p *Pipeline) Run() {
+	var reportStageBytes func() map[string]int64
+
+	defer func() {
+		if r := recover(); r != nil {
+			original, ok := r.(string)
+			if ok {
+				p.LastRun.Error = original
+			} else {
+				original, ok := r.(error)
+				if ok {
+					p.LastRun.Error = original.Error()
+				}
+			}
+
+			buf := make([]byte, 1<<16)
+			n := runtime.Stack(buf, false)
+			p.Logger.Error("Run failed", "err", r, "stack", string(buf[0:n]))
+		} else {
+			p.LastRun.Error = ""
+		}
+
+		startTime := p.StartedAt()
+		p.LastRun.StartTime = startTime
+
+		p.Logger.Info("Done", "took", p.Elapsed().String())
+
+		run := RunRecord{
+			Pipeline:     p.Name,
+			StartTime:    *startTime,
+			EndTime:      time.Now(),
+			BytesRead:    atomic.LoadInt64(&p.BytesRead),
+			BytesWritten: atomic.LoadInt64(&p.BytesWritten),
+			Error:        p.LastRun.Error,
+			LogTail:      p.Tail.Tail(),
+		}
+		if reportStageBytes != nil {
+			run.StageBytes = reportStageBytes()
+		}
+		if _, err := p.History.Save(run); err != nil {
+			p.Logger.Error("Failed to persist run history", "err", err)
+		}
+
+		p.mutex.Lock()
+		p.Working = false
+		p.StartTime = nil
+		p.mutex.Unlock()
+		atomic.StoreInt64(&p.BytesRead, 0)
+		atomic.StoreInt64(&p.BytesWritten, 0)
+		atomic.StoreInt64(&p.BufferedBytes, 0)
+	}()
+
+	p.Tail.Reset()
+
+	start := time.Now()
+	p.setStartTime(&start)
+	atomic.StoreInt64(&p.BytesRead, 0)
+	atomic.StoreInt64(&p.BytesWritten, 0)
+	atomic.StoreInt64(&p.BufferedBytes, 0)
+
+	p.Logger.Info("Started performing work", "source", p.Configuration.Source.Host, "destination", p.Configuration.Destination.Host)
+
+	sourceLog := p.Logger.New("stream", "source", "host", p.Configuration.Source.Host)
+	destLog := p.Logger.New("stream", "destination", "host", p.Configuration.Destination.Host)
+
+	sourceEndpoint, err := newEndpoint(p.Configuration.Source, sourceLog)
+	if err != nil {
+		panic(err.Error())
+	}
+	defer sourceEndpoint.Close()
+
+	destEndpoint, err := newEndpoint(p.Configuration.Destination, destLog)
+	if err != nil {
+		panic(err.Error())
+	}
+	defer destEndpoint.Close()
+
+	stdoutReader, sourceStdin, sourceDone := sourceEndpoint.Start(p.Configuration.Source.Command)
+	// The source command's stdin is never written to; close it
+	// immediately so it reads as EOF instead of hanging open.
+	sourceStdin.Close()
+
+	destStdout, stdinWriter, destDone := destEndpoint.Start(p.Configuration.Destination.Command)
+
+	pipelineWriter, report, err := buildStageChain(p.Configuration.Stages, stdinWriter)
+	if err != nil {
+		panic("Failed to set up pipeline stages: " + err.Error())
+	}
+	reportStageBytes = report
+
+	chunkSize := p.ChunkSize
+	queueDepth := int(p.MaxBufferBytes / int64(chunkSize))
+	if queueDepth < 1 {
+		queueDepth = 1
+	}
+
+	// chunks carries data from the reader goroutine to the writer
+	// goroutine. Its capacity bounds how far the source can read ahead
+	// of the destination, giving us backpressure for free.
+	chunks := make(chan []byte, queueDepth)
+
+	group, ctx := errgroup.WithContext(context.Background())
+
+	group.Go(func() error {
+		// Drain the destination's own stdout into its logger so it
+		// can't block on an unread pipe; it's informational, not part
+		// of the dump payload. If another goroutine fails and cancels
+		// ctx, the destination process may never exit on its own (e.g.
+		// it's still blocked waiting for stdin we've stopped writing
+		// to), so force this Copy to return by closing destStdout
+		// ourselves instead of waiting on an EOF that may never come.
+		copyDone := make(chan struct{})
+		go func() {
+			select {
+			case <-ctx.Done():
+				destStdout.Close()
+			case <-copyDone:
+			}
+		}()
+
+		_, err := io.Copy(LoggerWriter{destLog, log15.LvlInfo}, destStdout)
+		close(copyDone)
+		return err
+	})
+
+	group.Go(func() error {
+		sourceLog.Info("Starting read")
+		defer close(chunks)
+
+		buf := make([]byte, chunkSize)
+		for {
+			n, err := stdoutReader.Read(buf)
+			if n > 0 {
+				c := make([]byte, n)
+				copy(c, buf[0:n])
+				select {
+				case chunks <- c:
+					atomic.AddInt64(&p.BytesRead, int64(n))
+					atomic.AddInt64(&p.BufferedBytes, int64(n))
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		if err := <-sourceDone; err != nil {
+			return errors.New("Source command failed: " + err.Error())
+		}
+
+		sourceLog.Info("Finished reading source", "bytes", atomic.LoadInt64(&p.BytesRead))
+		return nil
+	})
+
+	group.Go(func() error {
+		destLog.Info("Starting write")
+
+		for {
+			select {
+			case c, ok := <-chunks:
+				if !ok {
+					destLog.Info("Finished writing destination", "bytes", atomic.LoadInt64(&p.BytesWritten))
+					destLog.Info("Waiting for destination command to complete")
+
+					pipelineWriter.Close()
+					if err := <-destDone; err != nil {
+						return errors.New("Destination command failed: " + err.Error())
+					}
+					return nil
+				}
+
+				nw, err := pipelineWriter.Write(c)
+				atomic.AddInt64(&p.BufferedBytes, -int64(len(c)))
+				if err != nil {
+					// Close pipelineWriter here too, not just on the
+					// clean-EOF path above: otherwise the destination's
+					// stdin is never closed, so a destination command
+					// that's merely blocked on more input (as opposed to
+					// one that's died outright) never exits, its stdout
+					// never reaches EOF, and the drain goroutine above
+					// blocks forever. Don't wait on destDone here; if the
+					// destination doesn't react to its stdin closing,
+					// that would just trade one permanent block for
+					// another.
+					pipelineWriter.Close()
+					return err
+				}
+
+				atomic.AddInt64(&p.BytesWritten, int64(nw))
+				destLog.Debug("Wrote chunk", "read", len(c), "wrote", nw)
+			case <-ctx.Done():
+				// Same reasoning as the write-error case above: another
+				// goroutine failed first and canceled ctx, so nothing
+				// more will arrive on chunks. Close pipelineWriter so the
+				// destination isn't left blocked on stdin that will
+				// never be written to again.
+				pipelineWriter.Close()
+				return ctx.Err()
+			}
+		}
+	})
+
+	// Any goroutine failing tears down both sessions instead of one
+	// side hanging forever on a pipe the other side has abandoned.
+	if err := group.Wait(); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"errors"
+	"github.com/inconshreveable/log15"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeEndpoint is a test-only Endpoint whose stdout/stdin/done are wired
+// up by hand, so a test can simulate a source or destination failing in
+// ways the real ssh/exec/docker endpoints only hit over a live
+// connection (a write that errors while the "process" itself never
+// exits, a read that errors outright, ...).
+type fakeEndpoint struct {
+	stdout io.ReadCloser
+	stdin  io.WriteCloser
+	done   chan error
+	closed int32
+}
+
+func (f *fakeEndpoint) Start(cmd string) (io.ReadCloser, io.WriteCloser, <-chan error) {
+	return f.stdout, f.stdin, f.done
+}
+
+func (f *fakeEndpoint) Close() error {
+	atomic.StoreInt32(&f.closed, 1)
+	return nil
+}
+
+var (
+	fakeEndpointsMu sync.Mutex
+	fakeEndpoints   = map[string]*fakeEndpoint{}
+)
+
+func init() {
+	registerEndpointDriver("fake", func(config EndpointConfiguration, logger log15.Logger) (Endpoint, error) {
+		fakeEndpointsMu.Lock()
+		defer fakeEndpointsMu.Unlock()
+
+		ep, ok := fakeEndpoints[config.Host]
+		if !ok {
+			return nil, errors.New("no fake endpoint registered for " + config.Host)
+		}
+		return ep, nil
+	})
+}
+
+// registerFakeEndpoint wires ep up under host for the lifetime of the
+// test, cleaning up afterwards so later tests don't see it.
+func registerFakeEndpoint(t *testing.T, host string, ep *fakeEndpoint) {
+	t.Helper()
+
+	fakeEndpointsMu.Lock()
+	fakeEndpoints[host] = ep
+	fakeEndpointsMu.Unlock()
+
+	t.Cleanup(func() {
+		fakeEndpointsMu.Lock()
+		delete(fakeEndpoints, host)
+		fakeEndpointsMu.Unlock()
+	})
+}
+
+type discardWriteCloser struct{}
+
+func (discardWriteCloser) Write(p []byte) (int, error) { return len(p), nil }
+func (discardWriteCloser) Close() error                { return nil }
+
+type errWriteCloser struct{ err error }
+
+func (w errWriteCloser) Write([]byte) (int, error) { return 0, w.err }
+func (w errWriteCloser) Close() error              { return nil }
+
+type errReadCloserForTest struct{ err error }
+
+func (r errReadCloserForTest) Read([]byte) (int, error) { return 0, r.err }
+func (r errReadCloserForTest) Close() error             { return nil }
+
+func testPipeline(t *testing.T, config PipelineConfiguration) *Pipeline {
+	t.Helper()
+
+	history, err := openRunHistory(filepath.Join(t.TempDir(), "history.db"))
+	if err != nil {
+		t.Fatalf("openRunHistory: %v", err)
+	}
+	t.Cleanup(func() { history.Close() })
+
+	appConfig := AppConfiguration{ChunkSize: 4096, MaxBufferBytes: 4096 * 4}
+	return newPipeline("test", config, appConfig, history)
+}
+
+// runWithTimeout runs p.Run() in a goroutine and fails the test instead
+// of hanging forever if it doesn't return in time — exactly the failure
+// mode a regression of the destination-teardown fix would produce.
+func runWithTimeout(t *testing.T, p *Pipeline) {
+	t.Helper()
+
+	done := make(chan struct{})
+	go func() {
+		p.Run()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Run() did not return within timeout; pipeline appears to have wedged")
+	}
+}
+
+func TestRunTearsDownOnDestinationWriteError(t *testing.T) {
+	writeErr := errors.New("write: connection reset")
+
+	source := &fakeEndpoint{
+		stdout: ioutil.NopCloser(strings.NewReader("hello, big-red")),
+		stdin:  discardWriteCloser{},
+		done:   make(chan error, 1),
+	}
+	source.done <- nil
+
+	// destStdout is a pipe nobody writes to or closes, standing in for a
+	// destination process that's still alive and blocked on stdin — it
+	// only ever reaches EOF if Run() closes it during teardown.
+	destStdoutR, destStdoutW := io.Pipe()
+	t.Cleanup(func() { destStdoutW.Close() })
+
+	dest := &fakeEndpoint{
+		stdout: destStdoutR,
+		stdin:  errWriteCloser{err: writeErr},
+		// Never sent to: the "destination command" never exits on its
+		// own, since nothing closed its stdin until Run() does.
+		done: make(chan error),
+	}
+
+	registerFakeEndpoint(t, "src-write-err", source)
+	registerFakeEndpoint(t, "dst-write-err", dest)
+
+	p := testPipeline(t, PipelineConfiguration{
+		Source:      EndpointConfiguration{Type: "fake", Host: "src-write-err", Command: "cat"},
+		Destination: EndpointConfiguration{Type: "fake", Host: "dst-write-err", Command: "cat"},
+	})
+
+	if !p.TryStart() {
+		t.Fatal("TryStart returned false on an idle pipeline")
+	}
+
+	runWithTimeout(t, p)
+
+	if p.Working {
+		t.Fatal("p.Working is still true after Run() returned")
+	}
+	if p.LastRun.Error == "" {
+		t.Fatal("expected LastRun.Error to record the write failure")
+	}
+	if atomic.LoadInt32(&source.closed) == 0 {
+		t.Fatal("source endpoint was never closed")
+	}
+	if atomic.LoadInt32(&dest.closed) == 0 {
+		t.Fatal("destination endpoint was never closed")
+	}
+}
+
+func TestRunTearsDownOnSourceReadError(t *testing.T) {
+	readErr := errors.New("read: connection reset")
+
+	source := &fakeEndpoint{
+		stdout: errReadCloserForTest{err: readErr},
+		stdin:  discardWriteCloser{},
+		done:   make(chan error, 1),
+	}
+
+	dest := &fakeEndpoint{
+		stdout: ioutil.NopCloser(strings.NewReader("")),
+		stdin:  discardWriteCloser{},
+		done:   make(chan error, 1),
+	}
+	dest.done <- nil
+
+	registerFakeEndpoint(t, "src-read-err", source)
+	registerFakeEndpoint(t, "dst-read-err", dest)
+
+	p := testPipeline(t, PipelineConfiguration{
+		Source:      EndpointConfiguration{Type: "fake", Host: "src-read-err", Command: "cat"},
+		Destination: EndpointConfiguration{Type: "fake", Host: "dst-read-err", Command: "cat"},
+	})
+
+	if !p.TryStart() {
+		t.Fatal("TryStart returned false on an idle pipeline")
+	}
+
+	runWithTimeout(t, p)
+
+	if p.Working {
+		t.Fatal("p.Working is still true after Run() returned")
+	}
+	if p.LastRun.Error == "" {
+		t.Fatal("expected LastRun.Error to record the read failure")
+	}
+	if atomic.LoadInt32(&source.closed) == 0 {
+		t.Fatal("source endpoint was never closed")
+	}
+	if atomic.LoadInt32(&dest.closed) == 0 {
+		t.Fatal("destination endpoint was never closed")
+	}
+}
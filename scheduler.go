@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"github.com/robfig/cron"
+	"io/ioutil"
+	"net/http"
+)
+
+// ScheduleConfiguration runs Pipeline on Cron in addition to manual
+// POST /press triggers. Retention, if set, caps how many completed runs
+// of this pipeline are kept in history.
+type ScheduleConfiguration struct {
+	ID        string
+	Cron      string
+	Pipeline  string
+	Retention int
+}
+
+// HookConfiguration lets an external CI system (drone, woodpecker, ...)
+// trigger Pipeline by POSTing to /hooks/:token with a body signed using
+// Secret, the same way GitHub/GitLab webhooks are verified.
+type HookConfiguration struct {
+	Token    string
+	Secret   string
+	Pipeline string
+}
+
+// Scheduler runs configured pipelines on their cron schedule,
+// independent of manual POST /press triggers.
+type Scheduler struct {
+	cron *cron.Cron
+}
+
+func newScheduler(state *AppState) (*Scheduler, error) {
+	c := cron.New()
+
+	for _, sched := range state.Configuration.Schedules {
+		sched := sched
+
+		pipeline, ok := state.Pipelines[sched.Pipeline]
+		if !ok {
+			return nil, errors.New("schedule " + sched.ID + " references unknown pipeline " + sched.Pipeline)
+		}
+
+		err := c.AddFunc(sched.Cron, func() {
+			state.runScheduled(sched, pipeline)
+		})
+		if err != nil {
+			return nil, errors.New("invalid cron expression for schedule " + sched.ID + ": " + err.Error())
+		}
+	}
+
+	return &Scheduler{cron: c}, nil
+}
+
+func (s *Scheduler) Start() {
+	s.cron.Start()
+}
+
+func (s *Scheduler) Stop() {
+	s.cron.Stop()
+}
+
+func (state *AppState) runScheduled(sched ScheduleConfiguration, pipeline *Pipeline) {
+	if !pipeline.TryStart() {
+		pipeline.Logger.Warn("Skipping scheduled run, already working", "schedule", sched.ID)
+		return
+	}
+
+	pipeline.Run()
+
+	if sched.Retention > 0 {
+		if err := state.History.Prune(pipeline.Name, sched.Retention); err != nil {
+			pipeline.Logger.Error("Failed to prune run history", "schedule", sched.ID, "err", err)
+		}
+	}
+}
+
+// triggerSchedule is used by POST /schedules/:id/run-now.
+func (state *AppState) triggerSchedule(id string) (*Pipeline, error) {
+	for _, sched := range state.Configuration.Schedules {
+		if sched.ID != id {
+			continue
+		}
+
+		pipeline, ok := state.Pipelines[sched.Pipeline]
+		if !ok {
+			return nil, errors.New("schedule references unknown pipeline " + sched.Pipeline)
+		}
+
+		// runScheduled does its own TryStart, so it must not be called
+		// on a pipeline already marked working here.
+		go state.runScheduled(sched, pipeline)
+
+		return pipeline, nil
+	}
+
+	return nil, errors.New("unknown schedule: " + id)
+}
+
+// triggerHook is used by POST /hooks/:token. The request body must carry
+// a valid HMAC-SHA256 signature of itself, hex-encoded, in the
+// X-Signature header, keyed with the matching HookConfiguration.Secret.
+func (state *AppState) triggerHook(token string, req *http.Request) (*Pipeline, error) {
+	var hook *HookConfiguration
+	for i := range state.Configuration.Hooks {
+		if state.Configuration.Hooks[i].Token == token {
+			hook = &state.Configuration.Hooks[i]
+			break
+		}
+	}
+	if hook == nil {
+		return nil, errors.New("unknown hook")
+	}
+
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return nil, errors.New("failed to read request body: " + err.Error())
+	}
+
+	mac := hmac.New(sha256.New, []byte(hook.Secret))
+	mac.Write(body)
+	expected := hex.EncodeToString(mac.Sum(nil))
+
+	signature := req.Header.Get("X-Signature")
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return nil, errors.New("invalid signature")
+	}
+
+	pipeline, ok := state.Pipelines[hook.Pipeline]
+	if !ok {
+		return nil, errors.New("hook references unknown pipeline " + hook.Pipeline)
+	}
+
+	if pipeline.TryStart() {
+		go pipeline.Run()
+	}
+
+	return pipeline, nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// hookTestState builds an AppState with the target pipeline already
+// marked Working, so a successful triggerHook call skips the goroutine
+// that would otherwise spin up a real pipeline run and leave it dangling
+// after the test finishes.
+func hookTestState(secret string) *AppState {
+	return &AppState{
+		Configuration: AppConfiguration{
+			Hooks: []HookConfiguration{
+				{Token: "the-token", Secret: secret, Pipeline: defaultPipelineName},
+			},
+		},
+		Pipelines: map[string]*Pipeline{
+			defaultPipelineName: {Name: defaultPipelineName, Working: true},
+		},
+	}
+}
+
+func signedRequest(body, secret string) *http.Request {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body))
+
+	req := httptest.NewRequest(http.MethodPost, "/hooks/the-token", bytes.NewBufferString(body))
+	req.Header.Set("X-Signature", hex.EncodeToString(mac.Sum(nil)))
+	return req
+}
+
+func TestTriggerHookAcceptsValidSignature(t *testing.T) {
+	state := hookTestState("shared-secret")
+
+	if _, err := state.triggerHook("the-token", signedRequest("payload", "shared-secret")); err != nil {
+		t.Fatalf("triggerHook: %v", err)
+	}
+}
+
+func TestTriggerHookRejectsBadSignature(t *testing.T) {
+	state := hookTestState("shared-secret")
+
+	req := signedRequest("payload", "wrong-secret")
+	if _, err := state.triggerHook("the-token", req); err == nil {
+		t.Fatal("expected an error for a mismatched signature")
+	}
+}
+
+func TestTriggerHookRejectsUnknownToken(t *testing.T) {
+	state := hookTestState("shared-secret")
+
+	req := signedRequest("payload", "shared-secret")
+	if _, err := state.triggerHook("not-the-token", req); err == nil {
+		t.Fatal("expected an error for an unknown hook token")
+	}
+}
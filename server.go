@@ -1,41 +1,79 @@
 package main
 
 import (
-	"bytes"
-	"code.google.com/p/go.crypto/ssh"
 	"encoding/json"
 	"github.com/go-martini/martini"
+	"github.com/inconshreveable/log15"
+	"github.com/martini-contrib/binding"
 	"github.com/martini-contrib/render"
-	"io"
-	"io/ioutil"
-	"log"
+	"net/http"
 	"os"
-	"runtime"
-	"sync"
+	"strconv"
+	"sync/atomic"
 	"time"
 )
 
-type LoggerWriter struct {
-	Logger *log.Logger
-}
-
-func (self LoggerWriter) Write(p []byte) (n int, err error) {
-	self.Logger.Print(string(p))
-
-	return len(p), nil
-}
+const (
+	defaultChunkSize     = 1 << 16 // 64KiB
+	defaultMaxBufferSize = 1 << 24 // 16MiB
+	defaultHistoryFile   = "big-red.db"
+)
 
 type EndpointConfiguration struct {
+	// Type selects the Endpoint driver: "ssh" (default), "exec", or
+	// "docker". Drivers are registered in endpointDrivers.
+	Type    string
 	User    string
 	Host    string
 	Command string
+	// Container is used by the "docker" driver to name the target
+	// container for `docker exec`.
+	Container string
+
+	// PrivateKeyFile, Password and KnownHostsFile are the "ssh"
+	// driver's credentials for this endpoint, so a source and
+	// destination can authenticate as different users against different
+	// known_hosts files. On the top-level Source and Destination, an
+	// empty PrivateKeyFile or KnownHostsFile falls back to the top-level
+	// AppConfiguration field of the same name; endpoints under Pipelines
+	// get no such fallback, and Password has no top-level counterpart.
+	PrivateKeyFile string
+	Password       string
+	KnownHostsFile string
 }
 
 type AppConfiguration struct {
 	PrivateKeyFile string
-	AuthMethods    []ssh.AuthMethod
+	// KnownHostsFile is the default known_hosts file ssh endpoints
+	// verify host keys against, trusting and recording a host's key the
+	// first time it's seen. Defaults to ~/.ssh/known_hosts.
+	KnownHostsFile string
 	Source         EndpointConfiguration
 	Destination    EndpointConfiguration
+	// Pipelines names additional source/destination pairs that schedules
+	// and the dashboard can reference besides the top-level Source and
+	// Destination, which are registered under "default" unless Pipelines
+	// already has a "default" entry.
+	Pipelines map[string]PipelineConfiguration
+	Schedules []ScheduleConfiguration
+	Hooks     []HookConfiguration
+	// MaxBufferBytes bounds how much data may be read ahead of the
+	// destination before the source is made to block (backpressure).
+	MaxBufferBytes int64
+	// ChunkSize is the size of each buffer passed between the reader
+	// and writer goroutines.
+	ChunkSize int
+	// LogLevel is one of debug/info/warn/error/crit. Defaults to info
+	// when empty or unrecognised; there is no trace level, so "trace"
+	// also logs at info.
+	LogLevel string
+	// LogJSON switches the log output from logfmt to JSON, for shipping
+	// to something like ELK or Loki.
+	LogJSON bool
+	// HistoryFile is the path to the bolt database that past runs are
+	// persisted to. Defaults to big-red.db.
+	HistoryFile string
+	Auth        AuthConfiguration
 }
 
 type LastRun struct {
@@ -44,11 +82,11 @@ type LastRun struct {
 }
 
 type AppState struct {
-	Working       bool
-	StartTime     *time.Time
 	Configuration AppConfiguration
-	Logger        *log.Logger
-	LastRun       LastRun
+	Logger        log15.Logger
+	History       *RunHistory
+	Pipelines     map[string]*Pipeline
+	Scheduler     *Scheduler
 }
 
 func NewAppState() *AppState {
@@ -64,32 +102,73 @@ func NewAppState() *AppState {
 		panic("Could not decode config.json: " + err.Error())
 	}
 
-	privKeyText, err := ioutil.ReadFile(config.PrivateKeyFile)
-	if err != nil {
-		panic("Failed to read private key: " + err.Error())
+	if config.PrivateKeyFile != "" {
+		// Fail fast on a bad default key at startup rather than on the
+		// first dump.
+		if _, err := loadSigner(config.PrivateKeyFile); err != nil {
+			panic(err.Error())
+		}
+	}
+	if config.Source.PrivateKeyFile == "" {
+		config.Source.PrivateKeyFile = config.PrivateKeyFile
+	}
+	if config.Destination.PrivateKeyFile == "" {
+		config.Destination.PrivateKeyFile = config.PrivateKeyFile
+	}
+	if config.Source.KnownHostsFile == "" {
+		config.Source.KnownHostsFile = config.KnownHostsFile
+	}
+	if config.Destination.KnownHostsFile == "" {
+		config.Destination.KnownHostsFile = config.KnownHostsFile
 	}
 
-	privKey, err := ssh.ParseRawPrivateKey(privKeyText)
-	if err != nil {
-		panic("Failed to parse private key: " + err.Error())
+	if config.ChunkSize <= 0 {
+		config.ChunkSize = defaultChunkSize
+	}
+	if config.MaxBufferBytes <= 0 {
+		config.MaxBufferBytes = defaultMaxBufferSize
+	}
+
+	if config.HistoryFile == "" {
+		config.HistoryFile = defaultHistoryFile
+	}
+
+	if config.Pipelines == nil {
+		config.Pipelines = map[string]PipelineConfiguration{}
 	}
+	if _, ok := config.Pipelines[defaultPipelineName]; !ok {
+		config.Pipelines[defaultPipelineName] = PipelineConfiguration{
+			Source:      config.Source,
+			Destination: config.Destination,
+		}
+	}
+
+	logger, _ := newLogger(config)
 
-	signer, err := ssh.NewSignerFromKey(privKey)
+	history, err := openRunHistory(config.HistoryFile)
 	if err != nil {
-		panic("Failed to create signer: " + err.Error())
+		panic("Failed to open run history: " + err.Error())
 	}
 
-	config.AuthMethods = []ssh.AuthMethod{
-		ssh.PublicKeys(signer),
+	pipelines := map[string]*Pipeline{}
+	for name, pipelineConfig := range config.Pipelines {
+		pipelines[name] = newPipeline(name, pipelineConfig, config, history)
 	}
 
-	logger := log.New(os.Stdout, "[big-red] ", 0)
+	state := &AppState{Configuration: config, Logger: logger, History: history, Pipelines: pipelines}
 
-	return &AppState{false, nil, config, logger, LastRun{"", nil}}
+	scheduler, err := newScheduler(state)
+	if err != nil {
+		panic("Failed to set up scheduler: " + err.Error())
+	}
+	state.Scheduler = scheduler
+
+	return state
 }
 
 func main() {
 	state := NewAppState()
+	state.Scheduler.Start()
 
 	m := martini.Classic()
 	m.Use(render.Renderer())
@@ -98,214 +177,110 @@ func main() {
 		r.HTML(200, "index", state)
 	})
 
-	m.Post("/press", func(r render.Render) {
-		if !state.Working {
-			go state.PerformDump()
+	m.Post("/login", binding.Bind(LoginRequest{}), func(req LoginRequest, r render.Render) {
+		token, err := state.login(req.Username, req.Password)
+		if err != nil {
+			r.JSON(http.StatusUnauthorized, map[string]string{"error": err.Error()})
+			return
 		}
 
-		r.JSON(200, nil)
-	})
-
-	m.Get("/status", func(r render.Render) {
-		r.JSON(200, map[string]interface{}{"working": state.Working, "startedAt": state.StartTime, "lastRun": map[string]interface{}{"error": state.LastRun.Error, "startedAt": state.LastRun.StartTime}})
+		r.JSON(200, map[string]string{"token": token})
 	})
 
-	m.Run()
-}
-
-func (state *AppState) PerformDump() {
-	defer func() {
-		if r := recover(); r != nil {
-			original, ok := r.(string)
-			if ok {
-				state.LastRun.Error = original
-			} else {
-				original, ok := r.(error)
-				if ok {
-					state.LastRun.Error = original.Error()
-				}
-			}
-
-			buf := make([]byte, 1<<16)
-			runtime.Stack(buf, false)
-			state.Logger.Println(r)
-			state.Logger.Println(buf)
-		} else {
-			state.LastRun.Error = ""
+	m.Post("/press", state.requireAuth, func(req *http.Request, r render.Render) {
+		pipeline, ok := state.pipelineFromRequest(req)
+		if !ok {
+			r.JSON(http.StatusNotFound, map[string]string{"error": "unknown pipeline"})
+			return
 		}
 
-		state.LastRun.StartTime = state.StartTime
-
-		state.Logger.Println("Done. Took " + state.Elapsed().String())
-
-		state.Working = false
-		state.StartTime = nil
-	}()
-
-	start := time.Now()
-	state.Working = true
-	state.StartTime = &start
-
-	state.Logger.Println("Started performing work")
-
-	sourceSession := state.newSourceSession()
-	defer sourceSession.Close()
-
-	destSession := state.newDestinationSession()
-	defer destSession.Close()
-
-	stdoutReader, err := sourceSession.StdoutPipe()
-	if err != nil {
-		panic("Could create pipe: " + err.Error())
-	}
-
-	stdinWriter, err := destSession.StdinPipe()
-	if err != nil {
-		panic("Could create pipe: " + err.Error())
-	}
-
-	loggerWriter := LoggerWriter{state.Logger}
-	destSession.Stdout = loggerWriter
-	destSession.Stderr = loggerWriter
-
-	sourceSession.Stderr = loggerWriter
-
-	if err := sourceSession.Start(state.Configuration.Source.Command); err != nil {
-		panic("Failed to run source command: " + err.Error())
-	}
+		if pipeline.TryStart() {
+			go pipeline.Run()
+		}
 
-	if err := destSession.Start(state.Configuration.Destination.Command); err != nil {
-		panic("Failed to run destination command: " + err.Error())
-	}
+		r.JSON(200, nil)
+	})
 
-	storage := bytes.Buffer{}
-	reading := true
-	bytesRead := 0
-	bytesWritten := 0
-	mutex := &sync.Mutex{}
-	wg := sync.WaitGroup{}
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		state.Logger.Println("Starting read")
-
-		buf := make([]byte, 4096)
-		for {
-			n, err := stdoutReader.Read(buf)
-			if err != nil && err != io.EOF {
-				panic(err)
-			}
-			if n == 0 {
-				break
-			}
-
-			mutex.Lock()
-			bytesRead += n
-			mutex.Unlock()
-
-			mutex.Lock()
-			_, err = storage.Write(buf[0:n])
-			mutex.Unlock()
-			if err != nil {
-				panic(err)
-			}
+	m.Get("/status", func(req *http.Request, r render.Render) {
+		pipeline, ok := state.pipelineFromRequest(req)
+		if !ok {
+			r.JSON(http.StatusNotFound, map[string]string{"error": "unknown pipeline"})
+			return
 		}
 
-		mutex.Lock()
-		reading = false
-		mutex.Unlock()
+		r.JSON(200, map[string]interface{}{
+			"pipeline":      pipeline.Name,
+			"working":       pipeline.Working,
+			"startedAt":     pipeline.StartedAt(),
+			"bytesRead":     atomic.LoadInt64(&pipeline.BytesRead),
+			"bytesWritten":  atomic.LoadInt64(&pipeline.BytesWritten),
+			"bufferedBytes": atomic.LoadInt64(&pipeline.BufferedBytes),
+			"lastRun":       map[string]interface{}{"error": pipeline.LastRun.Error, "startedAt": pipeline.LastRun.StartTime},
+		})
+	})
 
-		if err := sourceSession.Wait(); err != nil {
-			panic("Source command failed: " + err.Error())
+	m.Get("/runs", func(r render.Render) {
+		runs, err := state.History.List(50)
+		if err != nil {
+			r.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
 		}
 
-		state.Logger.Println("Finished reading source. Total size:", bytesRead, "bytes")
-	}()
-
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		state.Logger.Println("Starting write")
-
-		buf := make([]byte, 1<<21) // 2MiB
-		for {
-			mutex.Lock()
-			currentlyReading := reading
-			currentLength := storage.Len()
-			mutex.Unlock()
-
-			if currentlyReading && currentLength < cap(buf) {
-				continue
-
-			} else if !currentlyReading && currentLength <= 0 {
-				break
-			}
-
-			mutex.Lock()
-			n, err := storage.Read(buf)
-			mutex.Unlock()
-			if err != nil {
-				panic(err)
-			}
-			
-			nw, err := stdinWriter.Write(buf[0:n])
-			if err != nil {
-				panic(err)
-			}
-
-			bytesWritten += n
-			state.Logger.Println("Read", n, "bytes", "Wrote", nw, "bytes")
-		}
+		r.JSON(200, runs)
+	})
 
-		state.Logger.Println("Finished writing destination. Total size:", bytesWritten, "bytes")
-		state.Logger.Println("Waiting for destination command to complete")
+	m.Get("/runs/:id/log", func(params martini.Params, r render.Render) {
+		id, err := strconv.Atoi(params["id"])
+		if err != nil {
+			r.JSON(http.StatusBadRequest, map[string]string{"error": "invalid run id"})
+			return
+		}
 
-		stdinWriter.Close()
-		if err := destSession.Wait(); err != nil {
-			panic("Destination command failed: " + err.Error())
+		run, err := state.History.Get(id)
+		if err != nil {
+			r.JSON(http.StatusNotFound, map[string]string{"error": err.Error()})
+			return
 		}
-	}()
 
-	wg.Wait()
-}
+		r.JSON(200, run.LogTail)
+	})
 
-func (state *AppState) Elapsed() time.Duration {
-	return time.Since(*state.StartTime)
-}
+	m.Get("/schedules", func(r render.Render) {
+		r.JSON(200, state.Configuration.Schedules)
+	})
 
-func (state *AppState) newSourceSession() *ssh.Session {
-	return state.newSession(state.Configuration.Source.User, state.Configuration.Source.Host)
-}
+	m.Post("/schedules/:id/run-now", state.requireAuth, func(params martini.Params, r render.Render) {
+		pipeline, err := state.triggerSchedule(params["id"])
+		if err != nil {
+			r.JSON(http.StatusNotFound, map[string]string{"error": err.Error()})
+			return
+		}
 
-func (state *AppState) newDestinationSession() *ssh.Session {
-	return state.newSession(state.Configuration.Destination.User, state.Configuration.Destination.Host)
-}
+		r.JSON(200, map[string]string{"pipeline": pipeline.Name})
+	})
 
-func (state *AppState) newSession(user string, address string) *ssh.Session {
-	client := state.newClient(user, address)
+	m.Post("/hooks/:token", func(params martini.Params, req *http.Request, r render.Render) {
+		pipeline, err := state.triggerHook(params["token"], req)
+		if err != nil {
+			r.JSON(http.StatusUnauthorized, map[string]string{"error": err.Error()})
+			return
+		}
 
-	session, err := client.NewSession()
-	if err != nil {
-		panic("Failed to create session: " + err.Error())
-	}
+		r.JSON(200, map[string]string{"pipeline": pipeline.Name})
+	})
 
-	return session
+	m.Run()
 }
 
-func (state *AppState) newClient(user string, address string) *ssh.Client {
-	config := state.newClientConfig(user)
-
-	client, err := ssh.Dial("tcp", address+":22", config)
-	if err != nil {
-		panic("Failed to dial: " + err.Error())
+// pipelineFromRequest resolves the "pipeline" query parameter to a
+// registered Pipeline, falling back to "default" so existing /press and
+// /status callers keep working untouched.
+func (state *AppState) pipelineFromRequest(req *http.Request) (*Pipeline, bool) {
+	name := req.URL.Query().Get("pipeline")
+	if name == "" {
+		name = defaultPipelineName
 	}
 
-	return client
-}
-
-func (state *AppState) newClientConfig(user string) *ssh.ClientConfig {
-	return &ssh.ClientConfig{
-		User: user,
-		Auth: state.Configuration.AuthMethods,
-	}
+	pipeline, ok := state.Pipelines[name]
+	return pipeline, ok
 }
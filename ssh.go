@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"github.com/inconshreveable/log15"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+)
+
+func init() {
+	registerEndpointDriver("ssh", newSSHEndpoint)
+}
+
+// sshEndpoint runs the configured command over an SSH session, same as
+// big-red always has.
+type sshEndpoint struct {
+	client  *ssh.Client
+	session *ssh.Session
+	logger  log15.Logger
+}
+
+func newSSHEndpoint(config EndpointConfiguration, logger log15.Logger) (Endpoint, error) {
+	clientConfig, err := sshClientConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := ssh.Dial("tcp", config.Host+":22", clientConfig)
+	if err != nil {
+		return nil, errors.New("Failed to dial: " + err.Error())
+	}
+
+	session, err := client.NewSession()
+	if err != nil {
+		client.Close()
+		return nil, errors.New("Failed to create session: " + err.Error())
+	}
+
+	return &sshEndpoint{client: client, session: session, logger: logger}, nil
+}
+
+// sshClientConfig builds the auth methods and host key verification for
+// config. Public key, SSH agent and password auth are all tried, in
+// that order, so a key-based default can fall back to an agent or a
+// password per endpoint; host keys are checked against KnownHostsFile,
+// trusting and recording whatever key a host presents the first time
+// it's seen (TOFU) instead of the old behaviour of not checking host
+// keys at all.
+func sshClientConfig(config EndpointConfiguration) (*ssh.ClientConfig, error) {
+	var methods []ssh.AuthMethod
+
+	if config.PrivateKeyFile != "" {
+		signer, err := loadSigner(config.PrivateKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		methods = append(methods, ssh.PublicKeys(signer))
+	}
+
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		if conn, err := net.Dial("unix", sock); err == nil {
+			methods = append(methods, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+		}
+	}
+
+	if config.Password != "" {
+		methods = append(methods, ssh.Password(config.Password))
+	}
+
+	if len(methods) == 0 {
+		return nil, errors.New("no SSH auth methods configured for " + config.Host)
+	}
+
+	hostKeyCallback, err := newHostKeyCallback(config.KnownHostsFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ssh.ClientConfig{
+		User:            config.User,
+		Auth:            methods,
+		HostKeyCallback: hostKeyCallback,
+	}, nil
+}
+
+// loadSigner reads and parses a private key file into an ssh.Signer.
+func loadSigner(path string) (ssh.Signer, error) {
+	keyText, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.New("Failed to read private key: " + err.Error())
+	}
+
+	key, err := ssh.ParseRawPrivateKey(keyText)
+	if err != nil {
+		return nil, errors.New("Failed to parse private key: " + err.Error())
+	}
+
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return nil, errors.New("Failed to create signer: " + err.Error())
+	}
+
+	return signer, nil
+}
+
+// newHostKeyCallback loads knownHostsFile (defaulting to
+// ~/.ssh/known_hosts), creating it if it doesn't exist yet, and returns
+// a callback that trusts and appends a host's key the first time it's
+// seen instead of rejecting it outright.
+func newHostKeyCallback(knownHostsFile string) (ssh.HostKeyCallback, error) {
+	if knownHostsFile == "" {
+		knownHostsFile = defaultKnownHostsFile()
+	}
+
+	if _, err := os.Stat(knownHostsFile); os.IsNotExist(err) {
+		if err := ioutil.WriteFile(knownHostsFile, nil, 0600); err != nil {
+			return nil, errors.New("Failed to create known_hosts file: " + err.Error())
+		}
+	}
+
+	callback, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return nil, errors.New("Failed to load known_hosts: " + err.Error())
+	}
+
+	var mu sync.Mutex
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		mu.Lock()
+		defer mu.Unlock()
+
+		err := callback(hostname, remote, key)
+		if err == nil {
+			return nil
+		}
+
+		if keyErr, ok := err.(*knownhosts.KeyError); ok && len(keyErr.Want) == 0 {
+			if err := appendKnownHost(knownHostsFile, hostname, key); err != nil {
+				return err
+			}
+
+			// Reload so a later connection from the same host is
+			// checked against the key we just recorded, instead of
+			// the stale in-memory db from before this host was known.
+			reloaded, err := knownhosts.New(knownHostsFile)
+			if err != nil {
+				return errors.New("Failed to reload known_hosts: " + err.Error())
+			}
+			callback = reloaded
+
+			return nil
+		}
+
+		return err
+	}, nil
+}
+
+// appendKnownHost records a host's key as trusted for next time.
+func appendKnownHost(path string, hostname string, key ssh.PublicKey) error {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	line := knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key)
+
+	writer := bufio.NewWriter(file)
+	if _, err := writer.WriteString(line + "\n"); err != nil {
+		return err
+	}
+
+	return writer.Flush()
+}
+
+func defaultKnownHostsFile() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "known_hosts"
+	}
+
+	return home + "/.ssh/known_hosts"
+}
+
+func (e *sshEndpoint) Start(cmd string) (io.ReadCloser, io.WriteCloser, <-chan error) {
+	done := make(chan error, 1)
+
+	stdout, err := e.session.StdoutPipe()
+	if err != nil {
+		startErr := errors.New("Could not create pipe: " + err.Error())
+		done <- startErr
+		return errorReadCloser(startErr), errorWriteCloser(startErr), done
+	}
+
+	stdin, err := e.session.StdinPipe()
+	if err != nil {
+		startErr := errors.New("Could not create pipe: " + err.Error())
+		done <- startErr
+		return errorReadCloser(startErr), errorWriteCloser(startErr), done
+	}
+
+	e.session.Stderr = LoggerWriter{e.logger, log15.LvlWarn}
+
+	if err := e.session.Start(cmd); err != nil {
+		startErr := errors.New("Failed to run command: " + err.Error())
+		done <- startErr
+		return errorReadCloser(startErr), errorWriteCloser(startErr), done
+	}
+
+	go func() {
+		done <- e.session.Wait()
+	}()
+
+	// Closing the returned stdout closes the session, so a reader blocked
+	// on it returns instead of waiting for the remote command to exit.
+	return struct {
+		io.Reader
+		io.Closer
+	}{stdout, e.session}, stdin, done
+}
+
+func (e *sshEndpoint) Close() error {
+	e.session.Close()
+	return e.client.Close()
+}
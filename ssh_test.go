@@ -0,0 +1,84 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"golang.org/x/crypto/ssh"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testPublicKey(t *testing.T) ssh.PublicKey {
+	t.Helper()
+
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("ed25519.GenerateKey: %v", err)
+	}
+
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatalf("ssh.NewPublicKey: %v", err)
+	}
+	return sshPub
+}
+
+func TestHostKeyCallbackTrustsOnFirstUse(t *testing.T) {
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+
+	callback, err := newHostKeyCallback(knownHosts)
+	if err != nil {
+		t.Fatalf("newHostKeyCallback: %v", err)
+	}
+
+	key := testPublicKey(t)
+	addr := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 22}
+
+	if err := callback("example.com:22", addr, key); err != nil {
+		t.Fatalf("first connection should be trusted on first use, got: %v", err)
+	}
+
+	if _, err := os.Stat(knownHosts); err != nil {
+		t.Fatalf("expected known_hosts file to exist: %v", err)
+	}
+}
+
+func TestHostKeyCallbackAcceptsKnownKeyAgain(t *testing.T) {
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+
+	callback, err := newHostKeyCallback(knownHosts)
+	if err != nil {
+		t.Fatalf("newHostKeyCallback: %v", err)
+	}
+
+	key := testPublicKey(t)
+	addr := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 22}
+
+	if err := callback("example.com:22", addr, key); err != nil {
+		t.Fatalf("first connection: %v", err)
+	}
+	if err := callback("example.com:22", addr, key); err != nil {
+		t.Fatalf("second connection with the same key should also be trusted, got: %v", err)
+	}
+}
+
+func TestHostKeyCallbackRejectsChangedKey(t *testing.T) {
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+
+	callback, err := newHostKeyCallback(knownHosts)
+	if err != nil {
+		t.Fatalf("newHostKeyCallback: %v", err)
+	}
+
+	addr := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 22}
+
+	if err := callback("example.com:22", addr, testPublicKey(t)); err != nil {
+		t.Fatalf("first connection: %v", err)
+	}
+
+	if err := callback("example.com:22", addr, testPublicKey(t)); err == nil {
+		t.Fatal("expected an error when the host presents a different key than the one recorded")
+	}
+}
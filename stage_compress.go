@@ -0,0 +1,100 @@
+package main
+
+import (
+	"compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"io"
+)
+
+func init() {
+	registerStageDriver("gzip", newGzipStage)
+	registerStageDriver("zstd", newZstdStage)
+}
+
+type gzipStage struct {
+	level int
+}
+
+func newGzipStage(config StageConfig) (Stage, error) {
+	level := gzip.DefaultCompression
+	if config.Level != 0 {
+		level = config.Level
+	}
+
+	return gzipStage{level: level}, nil
+}
+
+func (gzipStage) Name() string {
+	return "gzip"
+}
+
+func (s gzipStage) Apply(dest io.WriteCloser) (io.WriteCloser, error) {
+	gz, err := gzip.NewWriterLevel(dest, s.level)
+	if err != nil {
+		return nil, err
+	}
+
+	return &gzipWriteCloser{gz: gz, dest: dest}, nil
+}
+
+type gzipWriteCloser struct {
+	gz   *gzip.Writer
+	dest io.WriteCloser
+}
+
+func (g *gzipWriteCloser) Write(p []byte) (int, error) {
+	return g.gz.Write(p)
+}
+
+func (g *gzipWriteCloser) Close() error {
+	if err := g.gz.Close(); err != nil {
+		g.dest.Close()
+		return err
+	}
+
+	return g.dest.Close()
+}
+
+type zstdStage struct {
+	level zstd.EncoderLevel
+}
+
+func newZstdStage(config StageConfig) (Stage, error) {
+	level := zstd.SpeedDefault
+	if config.Level > 0 {
+		level = zstd.EncoderLevelFromZstd(config.Level)
+	}
+
+	return zstdStage{level: level}, nil
+}
+
+func (zstdStage) Name() string {
+	return "zstd"
+}
+
+func (s zstdStage) Apply(dest io.WriteCloser) (io.WriteCloser, error) {
+	enc, err := zstd.NewWriter(dest, zstd.WithEncoderLevel(s.level))
+	if err != nil {
+		return nil, err
+	}
+
+	return &zstdWriteCloser{enc: enc, dest: dest}, nil
+}
+
+type zstdWriteCloser struct {
+	enc  *zstd.Encoder
+	dest io.WriteCloser
+}
+
+func (z *zstdWriteCloser) Write(p []byte) (int, error) {
+	return z.enc.Write(p)
+}
+
+func (z *zstdWriteCloser) Close() error {
+	if err := z.enc.Close(); err != nil {
+		z.dest.Close()
+		return err
+	}
+
+	return z.dest.Close()
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+)
+
+func init() {
+	registerStageDriver("encrypt", newEncryptStage)
+}
+
+// encryptStage encrypts the stream with AES-256-GCM under a pre-shared,
+// hex-encoded key. Each chunk written is sealed as its own nonce-prefixed
+// GCM record, so the stage can encrypt a stream of arbitrary length
+// without buffering it.
+type encryptStage struct {
+	aead cipher.AEAD
+}
+
+func newEncryptStage(config StageConfig) (Stage, error) {
+	if config.Key == "" {
+		return nil, errors.New("encrypt stage requires a Key")
+	}
+
+	key, err := hex.DecodeString(config.Key)
+	if err != nil {
+		return nil, errors.New("encrypt stage Key must be hex-encoded: " + err.Error())
+	}
+	if len(key) != 32 {
+		return nil, errors.New("encrypt stage Key must be 32 bytes for AES-256")
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return encryptStage{aead: aead}, nil
+}
+
+func (encryptStage) Name() string {
+	return "encrypt"
+}
+
+func (s encryptStage) Apply(dest io.WriteCloser) (io.WriteCloser, error) {
+	return &encryptWriteCloser{aead: s.aead, dest: dest}, nil
+}
+
+type encryptWriteCloser struct {
+	aead cipher.AEAD
+	dest io.WriteCloser
+}
+
+// Write seals p as a single GCM record: a big-endian uint32 record
+// length, then the random nonce followed by the sealed ciphertext. The
+// length covers the nonce and the ciphertext together.
+func (s *encryptWriteCloser) Write(p []byte) (int, error) {
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return 0, err
+	}
+
+	sealed := s.aead.Seal(nonce, nonce, p, nil)
+
+	length := []byte{
+		byte(len(sealed) >> 24),
+		byte(len(sealed) >> 16),
+		byte(len(sealed) >> 8),
+		byte(len(sealed)),
+	}
+
+	if _, err := s.dest.Write(length); err != nil {
+		return 0, err
+	}
+	if _, err := s.dest.Write(sealed); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+func (s *encryptWriteCloser) Close() error {
+	return s.dest.Close()
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"io"
+	"os"
+	"time"
+)
+
+func init() {
+	registerStageDriver("tee-file", newTeeFileStage)
+	registerStageDriver("tee-s3", newTeeS3Stage)
+}
+
+// teeFileStage copies every byte written through it to a local file,
+// passing the stream on to dest unchanged.
+type teeFileStage struct {
+	path string
+}
+
+func newTeeFileStage(config StageConfig) (Stage, error) {
+	if config.Path == "" {
+		return nil, errors.New("tee-file stage requires a Path")
+	}
+
+	return teeFileStage{path: config.Path}, nil
+}
+
+func (teeFileStage) Name() string {
+	return "tee-file"
+}
+
+func (s teeFileStage) Apply(dest io.WriteCloser) (io.WriteCloser, error) {
+	file, err := os.Create(s.path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &teeWriteCloser{tee: io.MultiWriter(dest, file), dest: dest, side: file}, nil
+}
+
+// teeS3Stage copies every byte written through it to an S3 object via a
+// streaming multipart upload, passing the stream on to dest unchanged.
+type teeS3Stage struct {
+	bucket string
+	key    string
+	acl    string
+	sess   *session.Session
+}
+
+func newTeeS3Stage(config StageConfig) (Stage, error) {
+	if config.Bucket == "" {
+		return nil, errors.New("tee-s3 stage requires a Bucket")
+	}
+
+	sess, err := session.NewSession(&aws.Config{
+		Region:      aws.String(config.Region),
+		Credentials: credentials.NewStaticCredentials(config.AccessKey, config.SecretKey, ""),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return teeS3Stage{bucket: config.Bucket, acl: config.ACL, sess: sess}, nil
+}
+
+func (teeS3Stage) Name() string {
+	return "tee-s3"
+}
+
+func (s teeS3Stage) Apply(dest io.WriteCloser) (io.WriteCloser, error) {
+	pipeReader, pipeWriter := io.Pipe()
+
+	uploadDone := make(chan error, 1)
+	go func() {
+		uploader := s3manager.NewUploader(s.sess)
+		_, err := uploader.Upload(&s3manager.UploadInput{
+			Bucket: aws.String(s.bucket),
+			Key:    aws.String(time.Now().UTC().Format("2006-01-02T150405") + ".dump"),
+			ACL:    aws.String(s.acl),
+			Body:   pipeReader,
+		})
+		uploadDone <- err
+	}()
+
+	return &teeWriteCloser{tee: io.MultiWriter(dest, pipeWriter), dest: dest, side: pipeWriter, wait: uploadDone}, nil
+}
+
+// teeWriteCloser fans writes out to dest and a side channel (a file or
+// an S3 upload pipe), then closes both on Close. wait, if set, is waited
+// on so the side channel's background work (e.g. the S3 upload) is
+// known to have finished or failed before Close returns.
+type teeWriteCloser struct {
+	tee  io.Writer
+	dest io.WriteCloser
+	side io.WriteCloser
+	wait <-chan error
+}
+
+func (t *teeWriteCloser) Write(p []byte) (int, error) {
+	return t.tee.Write(p)
+}
+
+func (t *teeWriteCloser) Close() error {
+	sideErr := t.side.Close()
+
+	if t.wait != nil {
+		if err := <-t.wait; err != nil {
+			sideErr = err
+		}
+	}
+
+	if err := t.dest.Close(); err != nil {
+		return err
+	}
+
+	return sideErr
+}
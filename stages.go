@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+)
+
+// StageConfig configures one stage of a pipeline's byte stream, applied
+// in order between the source command's stdout and the destination
+// command's stdin — e.g. dump -> compress -> encrypt -> archive to S3.
+type StageConfig struct {
+	Type string
+
+	// gzip/zstd
+	Level int
+
+	// encrypt: pre-shared AES-256 key, hex-encoded
+	Key string
+
+	// tee-file
+	Path string
+
+	// tee-s3: target bucket and ACL, static credentials and region
+	Bucket    string
+	ACL       string
+	AccessKey string
+	SecretKey string
+	Region    string
+}
+
+// Stage wraps an io.WriteCloser, applying a transform (or a side-channel
+// tee) to everything written to it before it reaches dest. Closing a
+// stage must flush/finalize itself and then close dest.
+type Stage interface {
+	Name() string
+	Apply(dest io.WriteCloser) (io.WriteCloser, error)
+}
+
+// StageDriver constructs a Stage from configuration. Drivers register
+// themselves in stageDrivers under the name used by StageConfig.Type.
+type StageDriver func(config StageConfig) (Stage, error)
+
+var stageDrivers = map[string]StageDriver{}
+
+func registerStageDriver(name string, driver StageDriver) {
+	stageDrivers[name] = driver
+}
+
+func newStage(config StageConfig) (Stage, error) {
+	driver, ok := stageDrivers[config.Type]
+	if !ok {
+		return nil, errors.New("unknown stage type: " + config.Type)
+	}
+
+	return driver(config)
+}
+
+// countingWriteCloser records how many bytes have passed through a
+// stage, so each stage's contribution can be attached to the run
+// record.
+type countingWriteCloser struct {
+	io.WriteCloser
+	count int64
+}
+
+func (c *countingWriteCloser) Write(p []byte) (int, error) {
+	n, err := c.WriteCloser.Write(p)
+	atomic.AddInt64(&c.count, int64(n))
+	return n, err
+}
+
+// buildStageChain wires the configured stages up in order and returns
+// the outermost writer to write the raw dump into. Closing it flushes
+// and closes every stage down to dest. The returned func reports each
+// stage's byte count, valid after the chain has been closed.
+func buildStageChain(configs []StageConfig, dest io.WriteCloser) (io.WriteCloser, func() map[string]int64, error) {
+	counters := map[string]*countingWriteCloser{}
+
+	writer := dest
+	for i := len(configs) - 1; i >= 0; i-- {
+		stage, err := newStage(configs[i])
+		if err != nil {
+			return nil, nil, err
+		}
+
+		wrapped, err := stage.Apply(writer)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// Key by position as well as name: two stages of the same type
+		// (e.g. two tee-file entries) would otherwise collapse onto the
+		// same counter.
+		key := fmt.Sprintf("%d:%s", i, stage.Name())
+		counted := &countingWriteCloser{WriteCloser: wrapped}
+		counters[key] = counted
+		writer = counted
+	}
+
+	report := func() map[string]int64 {
+		bytes := map[string]int64{}
+		for name, counter := range counters {
+			bytes[name] = atomic.LoadInt64(&counter.count)
+		}
+		return bytes
+	}
+
+	return writer, report, nil
+}
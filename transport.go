@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"github.com/inconshreveable/log15"
+	"io"
+)
+
+// Endpoint is a pluggable transport for running the configured command
+// on a source or destination and exchanging its stdio. SSH, local exec,
+// and Docker exec all implement it so the same pipe-one-command-to-
+// another machinery in Pipeline.Run works regardless of where the
+// command actually runs.
+type Endpoint interface {
+	// Start runs cmd and returns its stdout for reading, its stdin for
+	// writing, and a channel that receives the command's terminal error
+	// (nil on a clean exit) exactly once when it finishes. Stderr is
+	// piped to the logger the Endpoint was constructed with.
+	Start(cmd string) (io.ReadCloser, io.WriteCloser, <-chan error)
+	Close() error
+}
+
+// EndpointDriver constructs an Endpoint from configuration. Drivers
+// register themselves in endpointDrivers under the name used by the
+// Type field of EndpointConfiguration.
+type EndpointDriver func(config EndpointConfiguration, logger log15.Logger) (Endpoint, error)
+
+var endpointDrivers = map[string]EndpointDriver{}
+
+func registerEndpointDriver(name string, driver EndpointDriver) {
+	endpointDrivers[name] = driver
+}
+
+const defaultEndpointType = "ssh"
+
+func newEndpoint(config EndpointConfiguration, logger log15.Logger) (Endpoint, error) {
+	driverType := config.Type
+	if driverType == "" {
+		driverType = defaultEndpointType
+	}
+
+	driver, ok := endpointDrivers[driverType]
+	if !ok {
+		return nil, errors.New("unknown endpoint type: " + driverType)
+	}
+
+	return driver(config, logger)
+}
+
+// errorReadCloser returns an io.ReadCloser whose Read surfaces err instead
+// of blocking or panicking, for Start implementations that fail before
+// they have a real stdout pipe to hand back.
+func errorReadCloser(err error) io.ReadCloser {
+	pr, pw := io.Pipe()
+	pw.CloseWithError(err)
+	return pr
+}
+
+// errorWriteCloser returns an io.WriteCloser whose Write surfaces err
+// instead of blocking or panicking, for Start implementations that fail
+// before they have a real stdin pipe to hand back.
+func errorWriteCloser(err error) io.WriteCloser {
+	pr, pw := io.Pipe()
+	pr.CloseWithError(err)
+	return pw
+}